@@ -0,0 +1,197 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+    "context"
+    "encoding/binary"
+    "sync"
+
+    "github.com/boltdb/bolt"
+)
+
+var (
+    boltRecordsBucket = []byte("records")
+    boltMetaBucket    = []byte("meta")
+    boltCursorKey     = []byte("cursor")
+)
+
+// BoltBackend is a QueueBackend backed by a single BoltDB file.
+// Records are stored in the "records" bucket keyed by a monotonic
+// sequence number; the committed cursor lives in the "meta" bucket.
+// UpdateMeta deletes delivered records and writes the new cursor in
+// one Bolt transaction, so a crash between the two - the race
+// FileBackend's separate UpdateMeta/CleanUp calls are exposed to -
+// can't happen here: either both happen or neither does.
+type BoltBackend struct {
+    db *bolt.DB
+
+    lock      sync.Mutex
+    notify    chan struct{}
+    readSeq   uint64
+    commitSeq uint64
+}
+
+func NewBoltBackend(path string) (bb *BoltBackend, err error) {
+    db, err := bolt.Open(path, 0644, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    bb = &BoltBackend{db: db, notify: make(chan struct{}, 1)}
+
+    err = db.Update(func(tx *bolt.Tx) error {
+        if _, err := tx.CreateBucketIfNotExists(boltRecordsBucket); err != nil {
+            return err
+        }
+        meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+        if err != nil {
+            return err
+        }
+
+        if v := meta.Get(boltCursorKey); v != nil {
+            bb.commitSeq = binary.BigEndian.Uint64(v)
+        }
+        bb.readSeq = bb.commitSeq
+        return nil
+    })
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return bb, nil
+}
+
+func seqKey(seq uint64) []byte {
+    key := make([]byte, 8)
+    binary.BigEndian.PutUint64(key, seq)
+    return key
+}
+
+func (bb *BoltBackend) Write(p []byte) error {
+    err := bb.db.Update(func(tx *bolt.Tx) error {
+        records := tx.Bucket(boltRecordsBucket)
+        seq, err := records.NextSequence()
+        if err != nil {
+            return err
+        }
+        return records.Put(seqKey(seq), p)
+    })
+    if err != nil {
+        return err
+    }
+
+    select {
+    case bb.notify <- struct{}{}:
+    default:
+    }
+    return nil
+}
+
+func (bb *BoltBackend) Read() (p []byte, err error) {
+    bb.lock.Lock()
+    seq := bb.readSeq + 1
+    bb.lock.Unlock()
+
+    err = bb.db.View(func(tx *bolt.Tx) error {
+        v := tx.Bucket(boltRecordsBucket).Get(seqKey(seq))
+        if v == nil {
+            return nil
+        }
+        p = append([]byte(nil), v...) // copy out before the transaction closes
+        return nil
+    })
+    if err != nil || p == nil {
+        return nil, err
+    }
+
+    bb.lock.Lock()
+    bb.readSeq = seq
+    bb.lock.Unlock()
+    return p, nil
+}
+
+func (bb *BoltBackend) ReadContext(ctx context.Context) (p []byte, err error) {
+    for {
+        p, err = bb.Read()
+        if err != nil || p != nil {
+            return p, err
+        }
+
+        select {
+        case <-bb.notify:
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+}
+
+func (bb *BoltBackend) UpdateMeta() error {
+    bb.lock.Lock()
+    committed := bb.commitSeq
+    readSeq := bb.readSeq
+    bb.lock.Unlock()
+
+    if readSeq == committed {
+        return nil
+    }
+
+    err := bb.db.Update(func(tx *bolt.Tx) error {
+        records := tx.Bucket(boltRecordsBucket)
+        for seq := committed + 1; seq <= readSeq; seq++ {
+            if err := records.Delete(seqKey(seq)); err != nil {
+                return err
+            }
+        }
+        return tx.Bucket(boltMetaBucket).Put(boltCursorKey, seqKey(readSeq))
+    })
+    if err != nil {
+        return err
+    }
+
+    bb.lock.Lock()
+    bb.commitSeq = readSeq
+    bb.lock.Unlock()
+    return nil
+}
+
+func (bb *BoltBackend) RollbackMeta() error {
+    return bb.db.View(func(tx *bolt.Tx) error {
+        var committed uint64
+        if v := tx.Bucket(boltMetaBucket).Get(boltCursorKey); v != nil {
+            committed = binary.BigEndian.Uint64(v)
+        }
+
+        bb.lock.Lock()
+        bb.commitSeq = committed
+        bb.readSeq = committed
+        bb.lock.Unlock()
+        return nil
+    })
+}
+
+// CleanUp is a no-op: UpdateMeta already deletes delivered records in
+// the same Bolt transaction that commits the cursor, so there is never
+// a separate reclaim step for it to race against.
+func (bb *BoltBackend) CleanUp() error {
+    return nil
+}
+
+func (bb *BoltBackend) Close() {
+    bb.db.Close()
+}
+
+// Depth returns the number of records currently stored in the records
+// bucket, i.e. written but not yet committed-and-deleted via UpdateMeta.
+func (bb *BoltBackend) Depth() (int64, error) {
+    var n int64
+    err := bb.db.View(func(tx *bolt.Tx) error {
+        n = int64(tx.Bucket(boltRecordsBucket).Stats().KeyN)
+        return nil
+    })
+    return n, err
+}
+
+var _ QueueBackend = (*BoltBackend)(nil)
@@ -0,0 +1,135 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+    "context"
+    "log"
+    "sync"
+)
+
+// DefaultMemoryBackendCapacity is the record count a MemoryBackend
+// retains when constructed with capacity <= 0.
+const DefaultMemoryBackendCapacity = 10000
+
+// MemoryBackend is a QueueBackend that holds records only in memory,
+// bounded to a fixed number of records. It trades durability for
+// latency: queued points don't survive a restart, and once the ring
+// buffer is full the oldest record is dropped to make room for the
+// newest one, even if that record hasn't been read yet. It's meant for
+// ephemeral/low-latency deployments where buffering through a brief
+// backend blip matters more than surviving a crash.
+type MemoryBackend struct {
+    lock     sync.Mutex
+    notify   chan struct{}
+    capacity int
+
+    queue   [][]byte // oldest first
+    read    int      // index of the next record Read will return
+    commit  int      // index up to which records are committed and reclaimable
+    dropped int64
+}
+
+func NewMemoryBackend(capacity int) *MemoryBackend {
+    if capacity <= 0 {
+        capacity = DefaultMemoryBackendCapacity
+    }
+    return &MemoryBackend{
+        capacity: capacity,
+        notify: make(chan struct{}, 1),
+    }
+}
+
+func (mb *MemoryBackend) Write(p []byte) error {
+    mb.lock.Lock()
+
+    mb.queue = append(mb.queue, append([]byte(nil), p...))
+
+    if over := len(mb.queue) - mb.capacity; over > 0 {
+        mb.queue = mb.queue[over:]
+        if mb.read -= over; mb.read < 0 {
+            mb.read = 0
+        }
+        if mb.commit -= over; mb.commit < 0 {
+            mb.commit = 0
+        }
+        mb.dropped += int64(over)
+        log.Printf("memory backend dropped %d oldest record(s) at capacity %d (dropped_total=%d)",
+            over, mb.capacity, mb.dropped)
+    }
+
+    mb.lock.Unlock()
+
+    select {
+    case mb.notify <- struct{}{}:
+    default:
+    }
+    return nil
+}
+
+func (mb *MemoryBackend) Read() (p []byte, err error) {
+    mb.lock.Lock()
+    defer mb.lock.Unlock()
+
+    if mb.read >= len(mb.queue) {
+        return nil, nil
+    }
+    p = mb.queue[mb.read]
+    mb.read++
+    return p, nil
+}
+
+func (mb *MemoryBackend) ReadContext(ctx context.Context) (p []byte, err error) {
+    for {
+        p, err = mb.Read()
+        if err != nil || p != nil {
+            return p, err
+        }
+
+        select {
+        case <-mb.notify:
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+}
+
+func (mb *MemoryBackend) UpdateMeta() error {
+    mb.lock.Lock()
+    defer mb.lock.Unlock()
+    mb.commit = mb.read
+    return nil
+}
+
+func (mb *MemoryBackend) RollbackMeta() error {
+    mb.lock.Lock()
+    defer mb.lock.Unlock()
+    mb.read = mb.commit
+    return nil
+}
+
+func (mb *MemoryBackend) CleanUp() error {
+    mb.lock.Lock()
+    defer mb.lock.Unlock()
+
+    if mb.commit == 0 {
+        return nil
+    }
+    mb.queue = mb.queue[mb.commit:]
+    mb.read -= mb.commit
+    mb.commit = 0
+    return nil
+}
+
+func (mb *MemoryBackend) Close() {}
+
+// Depth returns the number of records currently unread.
+func (mb *MemoryBackend) Depth() (int64, error) {
+    mb.lock.Lock()
+    defer mb.lock.Unlock()
+    return int64(len(mb.queue) - mb.read), nil
+}
+
+var _ QueueBackend = (*MemoryBackend)(nil)
@@ -0,0 +1,55 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import "context"
+
+// QueueBackend is an ordered, single-consumer FIFO queue. The HTTP
+// proxy buffers points on one of these per downstream backend while
+// that backend is unreachable, then drains it once the backend comes
+// back. FileBackend and BoltBackend persist to disk; MemoryBackend
+// keeps records in memory only, so they do not survive a restart.
+//
+// Read/UpdateMeta/RollbackMeta mirror a commit log: Read advances a
+// local cursor over already-written records without making them
+// unavailable, UpdateMeta durably commits that cursor once the caller
+// has confirmed delivery, and RollbackMeta rewinds the cursor back to
+// the last commit so a failed delivery can be retried. CleanUp reclaims
+// storage behind the last committed cursor; implementations are free
+// to fold it into UpdateMeta instead (BoltBackend does, to make the
+// commit and the reclaim atomic).
+type QueueBackend interface {
+    // Write appends p to the queue; durably for the on-disk backends.
+    Write(p []byte) error
+
+    // Read returns the next unread record, or (nil, nil) if none is
+    // currently available.
+    Read() ([]byte, error)
+
+    // ReadContext blocks until the next record is available or ctx is
+    // cancelled.
+    ReadContext(ctx context.Context) ([]byte, error)
+
+    // UpdateMeta commits the consumer's current position; durably for
+    // the on-disk backends.
+    UpdateMeta() error
+
+    // RollbackMeta resets the consumer back to the position last
+    // committed by UpdateMeta.
+    RollbackMeta() error
+
+    // CleanUp reclaims storage for records at or before the last
+    // position committed by UpdateMeta.
+    CleanUp() error
+
+    // Close releases the backend's resources.
+    Close()
+
+    // Depth reports an approximate queue size, for admin/metrics
+    // display rather than precise accounting. The unit is
+    // backend-specific: bytes on disk for FileBackend, queued record
+    // count for MemoryBackend and BoltBackend.
+    Depth() (int64, error)
+}